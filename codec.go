@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/gif"
+	"image/png"
+	"io"
+	"os"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// ImageCodec abstracts over the on-disk image container so encodeFileToImage
+// can target PNG, TIFF, BMP or GIF without the rest of the pipeline caring.
+// Decoding doesn't need an equivalent interface: image.Decode already sniffs
+// the file header and dispatches to whichever format package registered
+// itself on import. Importing image/png, image/gif, golang.org/x/image/tiff
+// and golang.org/x/image/bmp here for their encoders also registers all
+// four decoders.
+type ImageCodec interface {
+	Encode(w io.Writer, img image.Image) error
+}
+
+// imageCodecs maps a -fmt flag value to its encoder.
+var imageCodecs = map[string]ImageCodec{
+	"png":  pngCodec{},
+	"tiff": tiffCodec{},
+	"bmp":  bmpCodec{},
+	"gif":  gifCodec{},
+}
+
+// codecForFormat resolves a -fmt value to its ImageCodec.
+func codecForFormat(format string) (ImageCodec, error) {
+	codec, ok := imageCodecs[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported image format: %s (supported: png, tiff, bmp, gif)", format)
+	}
+	return codec, nil
+}
+
+type pngCodec struct{}
+
+func (pngCodec) Encode(w io.Writer, img image.Image) error {
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	return enc.Encode(w, img)
+}
+
+// tiffCodec writes lossless, Deflate-compressed TIFF. TIFF also supports
+// multi-page images, which is attractive for chunking very large payloads
+// across pages, but writing multiple pages is left to a future request.
+type tiffCodec struct{}
+
+func (tiffCodec) Encode(w io.Writer, img image.Image) error {
+	return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate, Predictor: true})
+}
+
+// bmpCodec writes uncompressed BMP, useful for embedded use where a decoder
+// can't afford PNG/TIFF's compression overhead.
+type bmpCodec struct{}
+
+func (bmpCodec) Encode(w io.Writer, img image.Image) error {
+	return bmp.Encode(w, img)
+}
+
+type gifCodec struct{}
+
+func (gifCodec) Encode(w io.Writer, img image.Image) error {
+	return gif.Encode(w, img, &gif.Options{NumColors: 256})
+}
+
+// saveImage writes img to filename using the codec registered for format.
+func saveImage(img image.Image, filename string, format string) error {
+	codec, err := codecForFormat(format)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return codec.Encode(file, img)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// containerMagic identifies an Encolor-encoded payload.
+var containerMagic = [4]byte{'E', 'C', 'L', 'R'}
+
+// containerVersion is bumped whenever the header layout changes.
+const containerVersion = 1
+
+// containerHeaderSize is the on-disk size of containerHeader.Bytes().
+const containerHeaderSize = 4 + 1 + 1 + 1 + 1 + 4 + 4
+
+// containerHeader is a small fixed-size header embedded ahead of the
+// encoded payload so a decoder can validate integrity and recover the
+// exact original length without guessing at padding.
+type containerHeader struct {
+	Magic     [4]byte
+	Version   uint8
+	ColorMode uint8 // 0 = 8bit, 1 = 16bit, 2 = raw24, 3 = raw48
+	PaletteID uint8 // checksum of the active color map, detects scheme mismatches
+	Reserved  uint8
+	Length    uint32 // length in bytes of the original (pre-encoding) payload
+	CRC32     uint32 // IEEE CRC32 of the original payload
+}
+
+// colorModeByte maps a -m flag value to the byte stored in the header.
+func colorModeByte(colorMode string) uint8 {
+	switch colorMode {
+	case "8bit":
+		return 0
+	case "16bit":
+		return 1
+	case rawModeRaw24:
+		return 2
+	case rawModeRaw48:
+		return 3
+	}
+	return 1
+}
+
+// colorModeName is the inverse of colorModeByte.
+func colorModeName(b uint8) string {
+	switch b {
+	case 0:
+		return "8bit"
+	case 2:
+		return rawModeRaw24
+	case 3:
+		return rawModeRaw48
+	}
+	return "16bit"
+}
+
+// charsPerByteForMode returns how many encoded characters (octal digits or
+// hex digits) represent one payload byte in the given 8bit/16bit mode.
+func charsPerByteForMode(colorMode string) int {
+	if colorMode == "8bit" {
+		return 3
+	}
+	return 2
+}
+
+// paletteChecksum derives a 1-byte fingerprint of a color map so a decoder
+// can tell whether the payload was encoded with a different scheme.
+func paletteChecksum(colorMap map[byte][3]uint8) uint8 {
+	var sum uint32
+	for char, rgb := range colorMap {
+		sum += uint32(char)
+		sum += uint32(rgb[0]) + uint32(rgb[1]) + uint32(rgb[2])
+	}
+	return uint8(sum)
+}
+
+// newContainerHeader builds the header for a payload about to be encoded.
+func newContainerHeader(data []byte, colorMode string, colorMap map[byte][3]uint8) containerHeader {
+	return containerHeader{
+		Magic:     containerMagic,
+		Version:   containerVersion,
+		ColorMode: colorModeByte(colorMode),
+		PaletteID: paletteChecksum(colorMap),
+		Length:    uint32(len(data)),
+		CRC32:     crc32Checksum(data),
+	}
+}
+
+// Bytes serializes the header to its fixed-size wire format.
+func (h containerHeader) Bytes() []byte {
+	buf := make([]byte, containerHeaderSize)
+	copy(buf[0:4], h.Magic[:])
+	buf[4] = h.Version
+	buf[5] = h.ColorMode
+	buf[6] = h.PaletteID
+	buf[7] = h.Reserved
+	binary.BigEndian.PutUint32(buf[8:12], h.Length)
+	binary.BigEndian.PutUint32(buf[12:16], h.CRC32)
+	return buf
+}
+
+// parseContainerHeader decodes a header previously produced by Bytes.
+func parseContainerHeader(buf []byte) (containerHeader, error) {
+	var h containerHeader
+	if len(buf) != containerHeaderSize {
+		return h, fmt.Errorf("invalid header size: got %d bytes, want %d", len(buf), containerHeaderSize)
+	}
+	copy(h.Magic[:], buf[0:4])
+	if h.Magic != containerMagic {
+		return h, fmt.Errorf("bad magic bytes: %q", h.Magic[:])
+	}
+	h.Version = buf[4]
+	if h.Version != containerVersion {
+		return h, fmt.Errorf("unsupported container version: %d", h.Version)
+	}
+	h.ColorMode = buf[5]
+	h.PaletteID = buf[6]
+	h.Reserved = buf[7]
+	h.Length = binary.BigEndian.Uint32(buf[8:12])
+	h.CRC32 = binary.BigEndian.Uint32(buf[12:16])
+	return h, nil
+}
+
+// crc32Table is the standard IEEE 802.3 CRC32 lookup table (polynomial
+// 0xEDB88320), built once at startup.
+var crc32Table = buildCRC32Table()
+
+func buildCRC32Table() [256]uint32 {
+	var table [256]uint32
+	for n := uint32(0); n < 256; n++ {
+		c := n
+		for i := 0; i < 8; i++ {
+			if c&1 != 0 {
+				c = (c >> 1) ^ 0xEDB88320
+			} else {
+				c = c >> 1
+			}
+		}
+		table[n] = c
+	}
+	return table
+}
+
+// crc32Checksum computes the IEEE CRC32 checksum of data.
+func crc32Checksum(data []byte) uint32 {
+	c := uint32(0xffffffff)
+	for _, o := range data {
+		c = (c >> 8) ^ crc32Table[(c^uint32(o))&0xff]
+	}
+	return c ^ 0xffffffff
+}
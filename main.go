@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"image"
 	"image/color"
-	"image/png"
 	"log"
 	"math"
 	"os"
@@ -55,14 +54,28 @@ var colorMap8bit = map[byte][3]uint8{
 var reverseColorMap16bit = createReverseColorMap(colorMap16bit)
 var reverseColorMap8bit = createReverseColorMap(colorMap8bit)
 
+// activeColorMapForMode returns the currently loaded color map for the
+// given "8bit"/"16bit" mode, used to verify a decoded header's PaletteID
+// against the scheme actually in effect (colorMap8bit/colorMap16bit are
+// swapped out in place by parseSchemeFile when -sch is used).
+func activeColorMapForMode(colorMode string) map[byte][3]uint8 {
+	if colorMode == "8bit" {
+		return colorMap8bit
+	}
+	return colorMap16bit
+}
+
 func main() {
 	// Define command line flags
 	inputFile := flag.String("i", "", "Input file to convert")
 	outputFile := flag.String("o", "", "Output image file (PNG)")
-	colorMode := flag.String("m", "16bit", "Color mode: 8bit or 16bit")
+	colorMode := flag.String("m", "16bit", "Color mode: 8bit, 16bit, raw24 or raw48")
+	imageFormat := flag.String("fmt", "png", "Image container format: png, tiff, bmp or gif")
 	reconstruct := flag.Bool("re", false, "Reconstruct file from image")
 	schemeFile := flag.String("sch", "", "Color scheme file (or name from scheme folder)")
 	listSchemes := flag.Bool("sch-list", false, "List all available color schemes")
+	tolerant := flag.Bool("tolerant", false, "Decode lossy/photographed images by matching the nearest palette color")
+	maxDist := flag.Int("maxdist", 10000, "Max squared RGB distance for -tolerant matches before a pixel is treated as end-of-data")
 	flag.Parse()
 
 	// Handle scheme listing
@@ -92,8 +105,8 @@ func main() {
 	// Validate input
 	if *inputFile == "" && !*reconstruct {
 		fmt.Println("Usage:")
-		fmt.Println("  Encode: colorcode -i <inputfile> [-o <output.png>] [-m 8bit|16bit] [-sch <scheme>]")
-		fmt.Println("  Decode: colorcode -re -i <image.png> [-o <outputfile>]")
+		fmt.Println("  Encode: colorcode -i <inputfile> [-o <output.png>] [-m 8bit|16bit|raw24|raw48] [-fmt png|tiff|bmp|gif] [-sch <scheme>]")
+		fmt.Println("  Decode: colorcode -re -i <image.png> [-o <outputfile>] [-tolerant]")
 		fmt.Println("  List schemes: colorcode -sch-list")
 		fmt.Println("\nOptions:")
 		flag.PrintDefaults()
@@ -102,14 +115,14 @@ func main() {
 
 	if *reconstruct {
 		// Reconstruct file from image
-		err := reconstructFileFromImage(*inputFile, *outputFile)
+		err := reconstructFileFromImage(*inputFile, *outputFile, *tolerant, *maxDist, *colorMode)
 		if err != nil {
 			log.Fatalf("Error reconstructing file: %v", err)
 		}
 		fmt.Printf("Successfully reconstructed file: %s\n", *outputFile)
 	} else {
 		// Encode file to image
-		err := encodeFileToImage(*inputFile, *outputFile, *colorMode)
+		err := encodeFileToImage(*inputFile, *outputFile, *colorMode, *imageFormat)
 		if err != nil {
 			log.Fatalf("Error encoding file: %v", err)
 		}
@@ -506,7 +519,11 @@ func parseSchemeFile(filename string) error {
 	return scanner.Err()
 }
 
-func encodeFileToImage(inputFile, outputFile, colorMode string) error {
+func encodeFileToImage(inputFile, outputFile, colorMode, imageFormat string) error {
+	if _, err := codecForFormat(imageFormat); err != nil {
+		return err
+	}
+
 	// Read the input file
 	data, err := os.ReadFile(inputFile)
 	if err != nil {
@@ -515,33 +532,63 @@ func encodeFileToImage(inputFile, outputFile, colorMode string) error {
 
 	fmt.Printf("Read %d bytes from %s\n", len(data), inputFile)
 
-	var encodedData string
-	var colorMap map[byte][3]uint8
+	var img image.Image
 
-	if colorMode == "8bit" {
-		// Convert data to octal (base8)
-		encodedData = convertToOctal(data)
-		colorMap = colorMap8bit
-		fmt.Printf("Converted to %d octal characters (8-bit mode)\n", len(encodedData))
+	if isRawMode(colorMode) {
+		if err := checkRawFormatCompatible(imageFormat); err != nil {
+			return err
+		}
+
+		// Raw modes pack payload bytes straight into pixel channels instead
+		// of mapping characters to flat colors, so the header rides along
+		// as raw bytes ahead of the payload rather than as encoded chars.
+		header := newContainerHeader(data, colorMode, nil)
+		payload := append(header.Bytes(), data...)
+		img, err = createRawImageFromData(payload, colorMode)
+		if err != nil {
+			return fmt.Errorf("error creating image: %v", err)
+		}
 	} else {
-		// Convert data to hexadecimal (base16)
-		encodedData = hex.EncodeToString(data)
-		colorMap = colorMap16bit
-		fmt.Printf("Converted to %d hex characters (16-bit mode)\n", len(encodedData))
-	}
+		var encodedData string
+		var colorMap map[byte][3]uint8
+
+		if colorMode == "8bit" {
+			// Convert data to octal (base8)
+			encodedData = convertToOctal(data)
+			colorMap = colorMap8bit
+			fmt.Printf("Converted to %d octal characters (8-bit mode)\n", len(encodedData))
+		} else {
+			// Convert data to hexadecimal (base16)
+			encodedData = hex.EncodeToString(data)
+			colorMap = colorMap16bit
+			fmt.Printf("Converted to %d hex characters (16-bit mode)\n", len(encodedData))
+		}
 
-	// Create image from encoded data
-	img, err := createImageFromEncodedData(encodedData, colorMap, colorMode)
-	if err != nil {
-		return fmt.Errorf("error creating image: %v", err)
+		// Prepend an integrity-protected header (magic, version, color mode,
+		// palette checksum, original length, CRC32) so reconstruction can
+		// validate the payload and recover the exact original length.
+		header := newContainerHeader(data, colorMode, colorMap)
+		var headerEncoded string
+		if colorMode == "8bit" {
+			headerEncoded = convertToOctal(header.Bytes())
+		} else {
+			headerEncoded = hex.EncodeToString(header.Bytes())
+		}
+		encodedData = headerEncoded + encodedData
+
+		// Create image from encoded data
+		img, err = createImageFromEncodedData(encodedData, colorMap, colorMode)
+		if err != nil {
+			return fmt.Errorf("error creating image: %v", err)
+		}
 	}
 
 	// Save the image
 	if outputFile == "" {
-		outputFile = inputFile + "_encoded.png"
+		outputFile = inputFile + "_encoded." + imageFormat
 	}
 
-	err = saveImage(img, outputFile)
+	err = saveImage(img, outputFile, imageFormat)
 	if err != nil {
 		return fmt.Errorf("error saving image: %v", err)
 	}
@@ -549,10 +596,11 @@ func encodeFileToImage(inputFile, outputFile, colorMode string) error {
 	fmt.Printf("Successfully created image: %s\n", outputFile)
 	fmt.Printf("Image dimensions: %d x %d pixels\n", img.Bounds().Dx(), img.Bounds().Dy())
 	fmt.Printf("Color mode: %s\n", colorMode)
+	fmt.Printf("Image format: %s\n", imageFormat)
 	return nil
 }
 
-func reconstructFileFromImage(inputImage, outputFile string) error {
+func reconstructFileFromImage(inputImage, outputFile string, tolerant bool, maxDist int, requestedMode string) error {
 	// Read the image file
 	file, err := os.Open(inputImage)
 	if err != nil {
@@ -568,28 +616,90 @@ func reconstructFileFromImage(inputImage, outputFile string) error {
 
 	fmt.Printf("Read image with dimensions: %d x %d\n", img.Bounds().Dx(), img.Bounds().Dy())
 
+	if isRawMode(requestedMode) {
+		return reconstructRawFileFromImage(img, inputImage, outputFile, requestedMode)
+	}
+
 	// Reconstruct data from image
-	reconstructedData, colorMode, err := reconstructDataFromImage(img)
+	var reconstructedData, colorMode string
+	if tolerant {
+		reconstructedData, colorMode, err = reconstructDataFromImageTolerant(img, maxDist)
+	} else {
+		reconstructedData, colorMode, err = reconstructDataFromImage(img)
+	}
 	if err != nil {
 		return fmt.Errorf("error reconstructing data: %v", err)
 	}
 
 	fmt.Printf("Reconstructed data using %s color mode\n", colorMode)
 
+	// Split off the integrity header and decode it using the same
+	// per-character encoding as the payload.
+	headerChars := containerHeaderSize * 2
+	if colorMode == "8bit" {
+		headerChars = containerHeaderSize * 3
+	}
+	if len(reconstructedData) < headerChars {
+		return fmt.Errorf("image too small to contain a valid header")
+	}
+	headerEncoded := reconstructedData[:headerChars]
+	payloadEncoded := reconstructedData[headerChars:]
+
+	var headerBytes []byte
+	if colorMode == "8bit" {
+		headerBytes, err = convertFromOctal(headerEncoded)
+	} else {
+		headerBytes, err = hex.DecodeString(headerEncoded)
+	}
+	if err != nil {
+		return fmt.Errorf("error decoding header: %v", err)
+	}
+
+	header, err := parseContainerHeader(headerBytes)
+	if err != nil {
+		return fmt.Errorf("error parsing container header: %v", err)
+	}
+	if colorModeName(header.ColorMode) != colorMode {
+		return fmt.Errorf("header color mode %q does not match detected mode %q", colorModeName(header.ColorMode), colorMode)
+	}
+	if active := paletteChecksum(activeColorMapForMode(colorMode)); header.PaletteID != active {
+		return fmt.Errorf("header palette checksum %02x does not match the active %s scheme (%02x); decode with the scheme used to encode", header.PaletteID, colorMode, active)
+	}
+
+	// The header's Length field tells us exactly how many encoded
+	// characters are real payload; everything after that is white padding
+	// added to square off the image, so slice it off up front rather than
+	// decoding the padding and trying to truncate bytes afterwards (the
+	// padding's char count isn't guaranteed to be a whole number of
+	// hex/octal groups).
+	charsPerByte := 2
+	if colorMode == "8bit" {
+		charsPerByte = 3
+	}
+	payloadChars := int(header.Length) * charsPerByte
+	if payloadChars > len(payloadEncoded) {
+		return fmt.Errorf("header length %d exceeds decoded payload of %d characters", header.Length, len(payloadEncoded))
+	}
+	payloadEncoded = payloadEncoded[:payloadChars]
+
 	// Convert back to binary data
 	var binaryData []byte
 	if colorMode == "8bit" {
-		binaryData, err = convertFromOctal(reconstructedData)
+		binaryData, err = convertFromOctal(payloadEncoded)
 		if err != nil {
 			return fmt.Errorf("error converting from octal: %v", err)
 		}
 	} else {
-		binaryData, err = hex.DecodeString(reconstructedData)
+		binaryData, err = hex.DecodeString(payloadEncoded)
 		if err != nil {
 			return fmt.Errorf("error decoding hex: %v", err)
 		}
 	}
 
+	if checksum := crc32Checksum(binaryData); checksum != header.CRC32 {
+		return fmt.Errorf("CRC32 mismatch: image data is corrupted (got %08x, want %08x)", checksum, header.CRC32)
+	}
+
 	// Save the reconstructed file
 	if outputFile == "" {
 		outputFile = inputImage + "_decoded"
@@ -603,7 +713,7 @@ func reconstructFileFromImage(inputImage, outputFile string) error {
 	return nil
 }
 
-func createImageFromEncodedData(encodedData string, colorMap map[byte][3]uint8, colorMode string) (*image.RGBA, error) {
+func createImageFromEncodedData(encodedData string, colorMap map[byte][3]uint8, colorMode string) (*image.Paletted, error) {
 	// Calculate image dimensions to be as square as possible
 	dataLength := len(encodedData)
 	width := int(math.Ceil(math.Sqrt(float64(dataLength))))
@@ -611,8 +721,12 @@ func createImageFromEncodedData(encodedData string, colorMap map[byte][3]uint8,
 
 	fmt.Printf("Creating image with dimensions: %d x %d\n", width, height)
 
-	// Create a new RGBA image
-	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	// Build a palette straight from the active color map so PNG can emit a
+	// PLTE-indexed image (4 bits/pixel for the 8- and 16-entry palettes)
+	// instead of full 32-bit RGBA.
+	palette, index, blackIdx, whiteIdx := buildPalette(colorMap)
+
+	img := image.NewPaletted(image.Rect(0, 0, width, height), palette)
 
 	// Set pixels based on encoded data
 	for i, char := range encodedData {
@@ -625,42 +739,79 @@ func createImageFromEncodedData(encodedData string, colorMap map[byte][3]uint8,
 
 		// Get color for this character
 		colorVal, exists := colorMap[byte(char)]
-		if !exists {
-			// Use black for unknown characters
-			colorVal = [3]uint8{0, 0, 0}
+		idx := blackIdx
+		if exists {
+			idx = index[colorVal]
 		}
 
-		// Set the pixel color
-		img.Set(x, y, color.RGBA{
-			R: colorVal[0],
-			G: colorVal[1],
-			B: colorVal[2],
-			A: 255,
-		})
+		img.SetColorIndex(x, y, idx)
 	}
 
 	// Fill remaining pixels with white (to distinguish from data)
 	for i := len(encodedData); i < width*height; i++ {
 		x := i % width
 		y := i / width
-		img.Set(x, y, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+		img.SetColorIndex(x, y, whiteIdx)
 	}
 
 	return img, nil
 }
 
+// buildPalette turns a character->RGB color map into a color.Palette
+// suitable for image.Paletted, plus a reverse RGB->index lookup and the
+// indices of the guaranteed black (fallback for unknown characters) and
+// white (end-of-data padding) entries.
+func buildPalette(colorMap map[byte][3]uint8) (palette color.Palette, index map[[3]uint8]uint8, blackIdx, whiteIdx uint8) {
+	index = make(map[[3]uint8]uint8)
+
+	add := func(rgb [3]uint8) uint8 {
+		if idx, ok := index[rgb]; ok {
+			return idx
+		}
+		idx := uint8(len(palette))
+		palette = append(palette, color.RGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: 255})
+		index[rgb] = idx
+		return idx
+	}
+
+	// Sort characters for a stable, reproducible palette ordering.
+	chars := make([]byte, 0, len(colorMap))
+	for char := range colorMap {
+		chars = append(chars, char)
+	}
+	for i := 0; i < len(chars); i++ {
+		for j := i + 1; j < len(chars); j++ {
+			if chars[i] > chars[j] {
+				chars[i], chars[j] = chars[j], chars[i]
+			}
+		}
+	}
+	for _, char := range chars {
+		add(colorMap[char])
+	}
+
+	whiteIdx = add([3]uint8{255, 255, 255})
+	blackIdx = add([3]uint8{0, 0, 0})
+	return palette, index, blackIdx, whiteIdx
+}
+
 func reconstructDataFromImage(img image.Image) (string, string, error) {
 	bounds := img.Bounds()
 	width := bounds.Dx()
 	height := bounds.Dy()
 
-	whitePixels := 0
-
 	// Try both color modes and see which one gives more valid characters
 	var results16bit, results8bit strings.Builder
 	valid16bit := 0
 	valid8bit := 0
 
+	// Every pixel, including the white padding used to square off the
+	// image, decodes through the same reverse map as real data (white is
+	// just the color for char '1'). The container header's Length field is
+	// what actually marks where real data ends, so padding pixels simply
+	// become trailing '1' characters that get truncated away once the
+	// header is parsed; there's no ambiguous "end of data" pixel to detect
+	// here.
 	for y := 0; y < height; y++ {
 		for x := 0; x < width; x++ {
 			pixel := img.At(x, y)
@@ -670,12 +821,6 @@ func reconstructDataFromImage(img image.Image) (string, string, error) {
 			g8 := uint8(g >> 8)
 			b8 := uint8(b >> 8)
 
-			// Check if pixel is white (end of data)
-			if r8 == 255 && g8 == 255 && b8 == 255 {
-				whitePixels++
-				continue
-			}
-
 			color := [3]uint8{r8, g8, b8}
 
 			// Try 16-bit mapping
@@ -692,6 +837,16 @@ func reconstructDataFromImage(img image.Image) (string, string, error) {
 		}
 	}
 
+	// Octal digits '0'-'7' are a strict subset of the 16-bit hex palette, so
+	// an image actually encoded in 8-bit mode decodes completely under both
+	// maps and ties on character count. Break the tie using the embedded
+	// container header's own magic bytes, which only validate under the
+	// mode that really produced the image.
+	if valid16bit == valid8bit && headerLooksValid(results8bit.String(), "8bit") && !headerLooksValid(results16bit.String(), "16bit") {
+		fmt.Printf("Detected 8-bit color mode (%d valid characters)\n", valid8bit)
+		return results8bit.String(), "8bit", nil
+	}
+
 	// Determine which color mode was used based on valid character count
 	if valid16bit >= valid8bit {
 		fmt.Printf("Detected 16-bit color mode (%d valid characters)\n", valid16bit)
@@ -702,6 +857,34 @@ func reconstructDataFromImage(img image.Image) (string, string, error) {
 	}
 }
 
+// headerLooksValid reports whether the first encoded container header in s
+// parses successfully under colorMode. Used to disambiguate the 8-bit/16-bit
+// character-count tie above, since a valid magic+version match is far
+// stronger evidence than which palette happens to contain more matches.
+func headerLooksValid(s, colorMode string) bool {
+	headerChars := containerHeaderSize * 2
+	if colorMode == "8bit" {
+		headerChars = containerHeaderSize * 3
+	}
+	if len(s) < headerChars {
+		return false
+	}
+
+	var headerBytes []byte
+	var err error
+	if colorMode == "8bit" {
+		headerBytes, err = convertFromOctal(s[:headerChars])
+	} else {
+		headerBytes, err = hex.DecodeString(s[:headerChars])
+	}
+	if err != nil {
+		return false
+	}
+
+	_, err = parseContainerHeader(headerBytes)
+	return err == nil
+}
+
 func createReverseColorMap(colorMap map[byte][3]uint8) map[[3]uint8]byte {
 	reverseMap := make(map[[3]uint8]byte)
 	for char, color := range colorMap {
@@ -736,12 +919,3 @@ func convertFromOctal(octalStr string) ([]byte, error) {
 	return result, nil
 }
 
-func saveImage(img *image.RGBA, filename string) error {
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	return png.Encode(file, img)
-}
\ No newline at end of file
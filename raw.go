@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+)
+
+// rawModeRaw24 and rawModeRaw48 are the -m values for the high-density
+// modes that pack raw payload bytes straight into pixel channels instead of
+// mapping one character to one flat color. raw24 uses 8-bit channels (3
+// payload bytes/pixel); raw48 uses 16-bit channels (6 payload bytes/pixel).
+const (
+	rawModeRaw24 = "raw24"
+	rawModeRaw48 = "raw48"
+)
+
+// isRawMode reports whether colorMode is one of the raw packed modes.
+func isRawMode(colorMode string) bool {
+	return colorMode == rawModeRaw24 || colorMode == rawModeRaw48
+}
+
+// rawCompatibleFormats lists the -fmt values that can round-trip a raw
+// image exactly: both are lossless truecolor-with-alpha formats. BMP's
+// plain 32bpp encoding is decoded back without alpha (the format needs a
+// BITFIELDS header x/image/bmp's encoder never writes), and GIF quantizes
+// to a 256-color palette, so neither can carry raw mode's per-pixel byte
+// packing without corrupting it.
+var rawCompatibleFormats = map[string]bool{
+	"png":  true,
+	"tiff": true,
+}
+
+// checkRawFormatCompatible returns an error if imageFormat can't round-trip
+// a raw24/raw48 image losslessly.
+func checkRawFormatCompatible(imageFormat string) error {
+	if !rawCompatibleFormats[imageFormat] {
+		return fmt.Errorf("raw24/raw48 modes need a lossless, alpha-preserving format; %s can't round-trip them (use -fmt png or tiff)", imageFormat)
+	}
+	return nil
+}
+
+// rawBytesPerPixel returns how many raw payload bytes a single pixel of the
+// given raw mode carries across its R, G and B channels.
+func rawBytesPerPixel(colorMode string) int {
+	if colorMode == rawModeRaw48 {
+		return 6
+	}
+	return 3
+}
+
+// createRawImageFromData packs payload 3 (raw24) or 6 (raw48) bytes per
+// pixel into R, G, B. The alpha channel carries the count of valid payload
+// bytes in that pixel (so the final, possibly partial, pixel round-trips
+// exactly), and a trailing sentinel pixel with alpha 0 marks end-of-data.
+//
+// The image uses the non-premultiplied NRGBA(64) color model rather than
+// RGBA(64): our alpha is a byte-count marker, not real opacity, and
+// RGBA(64)'s premultiplied model scales R/G/B by alpha/0xffff on every
+// encode/decode round-trip through PNG, mangling the payload for any
+// alpha other than 0 or max.
+func createRawImageFromData(payload []byte, colorMode string) (image.Image, error) {
+	bpp := rawBytesPerPixel(colorMode)
+	pixelCount := (len(payload) + bpp - 1) / bpp
+	totalPixels := pixelCount + 1 // + end-of-data sentinel
+
+	width := int(math.Ceil(math.Sqrt(float64(totalPixels))))
+	height := int(math.Ceil(float64(totalPixels) / float64(width)))
+
+	fmt.Printf("Creating raw image with dimensions: %d x %d\n", width, height)
+
+	if colorMode == rawModeRaw48 {
+		img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+		for i := 0; i < pixelCount; i++ {
+			x, y := i%width, i/width
+			chunk := rawChunk(payload, i, bpp)
+			var b [6]byte
+			copy(b[:], chunk)
+			img.SetNRGBA64(x, y, color.NRGBA64{
+				R: uint16(b[0])<<8 | uint16(b[1]),
+				G: uint16(b[2])<<8 | uint16(b[3]),
+				B: uint16(b[4])<<8 | uint16(b[5]),
+				A: uint16(len(chunk)),
+			})
+		}
+		sx, sy := pixelCount%width, pixelCount/width
+		img.SetNRGBA64(sx, sy, color.NRGBA64{A: 0})
+		return img, nil
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < pixelCount; i++ {
+		x, y := i%width, i/width
+		chunk := rawChunk(payload, i, bpp)
+		var b [3]byte
+		copy(b[:], chunk)
+		img.SetNRGBA(x, y, color.NRGBA{R: b[0], G: b[1], B: b[2], A: uint8(len(chunk))})
+	}
+	sx, sy := pixelCount%width, pixelCount/width
+	img.SetNRGBA(sx, sy, color.NRGBA{A: 0})
+	return img, nil
+}
+
+// rawChunk returns the slice of payload carried by pixel i.
+func rawChunk(payload []byte, i, bpp int) []byte {
+	start := i * bpp
+	end := start + bpp
+	if end > len(payload) {
+		end = len(payload)
+	}
+	return payload[start:end]
+}
+
+// reconstructRawDataFromImage reverses createRawImageFromData, reading
+// pixels in row-major order until it hits the alpha-0 sentinel pixel.
+//
+// It reads the concrete color struct's fields directly rather than calling
+// .RGBA(), which alpha-premultiplies: our alpha channel isn't real opacity,
+// it's a small byte-count marker, and premultiplying by it would corrupt
+// every R/G/B value on the way back out.
+func reconstructRawDataFromImage(img image.Image, colorMode string) ([]byte, error) {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	var result []byte
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			px := img.At(bounds.Min.X+x, bounds.Min.Y+y)
+
+			var chunk []byte
+			var valid int
+			switch c := px.(type) {
+			case color.NRGBA:
+				chunk = []byte{c.R, c.G, c.B}
+				valid = int(c.A)
+			case color.RGBA:
+				chunk = []byte{c.R, c.G, c.B}
+				valid = int(c.A)
+			case color.NRGBA64:
+				chunk = []byte{byte(c.R >> 8), byte(c.R), byte(c.G >> 8), byte(c.G), byte(c.B >> 8), byte(c.B)}
+				valid = int(c.A)
+			case color.RGBA64:
+				chunk = []byte{byte(c.R >> 8), byte(c.R), byte(c.G >> 8), byte(c.G), byte(c.B >> 8), byte(c.B)}
+				valid = int(c.A)
+			default:
+				return nil, fmt.Errorf("unsupported pixel type %T for raw mode %s", px, colorMode)
+			}
+
+			if valid == 0 {
+				return result, nil
+			}
+			if valid > len(chunk) {
+				valid = len(chunk)
+			}
+			result = append(result, chunk[:valid]...)
+		}
+	}
+
+	return nil, fmt.Errorf("reached end of image without finding the end-of-data sentinel pixel")
+}
+
+// reconstructRawFileFromImage decodes a raw24/raw48 image, validates the
+// embedded container header, and writes the recovered file to disk.
+func reconstructRawFileFromImage(img image.Image, inputImage, outputFile, colorMode string) error {
+	payload, err := reconstructRawDataFromImage(img, colorMode)
+	if err != nil {
+		return fmt.Errorf("error reconstructing raw data: %v", err)
+	}
+
+	if len(payload) < containerHeaderSize {
+		return fmt.Errorf("image too small to contain a valid header")
+	}
+	header, err := parseContainerHeader(payload[:containerHeaderSize])
+	if err != nil {
+		return fmt.Errorf("error parsing container header: %v", err)
+	}
+	if colorModeName(header.ColorMode) != colorMode {
+		return fmt.Errorf("header color mode %q does not match requested mode %q", colorModeName(header.ColorMode), colorMode)
+	}
+	if active := paletteChecksum(nil); header.PaletteID != active {
+		return fmt.Errorf("header palette checksum %02x does not match the expected raw-mode checksum (%02x); image is corrupted or not a raw-mode encode", header.PaletteID, active)
+	}
+
+	binaryData := payload[containerHeaderSize:]
+	if int(header.Length) > len(binaryData) {
+		return fmt.Errorf("header length %d exceeds decoded payload of %d bytes", header.Length, len(binaryData))
+	}
+	binaryData = binaryData[:header.Length]
+
+	if checksum := crc32Checksum(binaryData); checksum != header.CRC32 {
+		return fmt.Errorf("CRC32 mismatch: image data is corrupted (got %08x, want %08x)", checksum, header.CRC32)
+	}
+
+	if outputFile == "" {
+		outputFile = inputImage + "_decoded"
+	}
+	if err := os.WriteFile(outputFile, binaryData, 0644); err != nil {
+		return fmt.Errorf("error writing reconstructed file: %v", err)
+	}
+
+	fmt.Printf("Reconstructed %d bytes of data\n", len(binaryData))
+	return nil
+}
@@ -0,0 +1,657 @@
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"image/color"
+	"io"
+)
+
+// defaultStreamWidth is the row width used by Encoder when the caller
+// doesn't otherwise need a specific aspect ratio. Unlike encodeFileToImage,
+// which squares the image to the total payload size, Encoder picks a fixed
+// width and grows downward.
+const defaultStreamWidth = 1024
+
+// pngSignature is the fixed 8-byte magic every PNG file starts with.
+var pngSignature = [8]byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+
+// idatChunkSize bounds how many compressed bytes Encoder buffers before
+// flushing an IDAT chunk. It's a small, fixed amount, not proportional to
+// the payload size, so it doesn't compromise the O(width) memory goal.
+const idatChunkSize = 32 * 1024
+
+// EncoderOptions configures a streaming Encoder.
+type EncoderOptions struct {
+	ColorMode string // "8bit" or "16bit"; raw modes aren't supported here
+	Width     int    // row width in pixels; 0 uses defaultStreamWidth
+	Length    int64  // total payload length in bytes; must be known up front
+}
+
+// Encoder streams payload bytes straight into a hand-written, chunked PNG
+// so a caller feeding it a multi-GB file never has to hold the whole file,
+// or a full image.Image of the output, in memory at once: at most one
+// scanline (width palette indices) is ever buffered before being pushed
+// through zlib and flushed as a PNG IDAT chunk.
+//
+// This requires knowing the total payload length before the first byte
+// arrives, since the PNG container's IHDR chunk (and therefore the image's
+// height) must be written before any pixel data follows - so callers set
+// EncoderOptions.Length instead of Encoder inferring it from Close. The
+// payload's CRC32, which genuinely can't be known until the last byte is
+// written, can't take the same shortcut: the header is written up front
+// with a zero placeholder, and the real CRC32 is appended as a small
+// trailer immediately after the payload, before any trailing white
+// padding. A Decoder validates that trailer once it has streamed exactly
+// Length bytes back out.
+type Encoder struct {
+	w         io.Writer
+	colorMode string
+	colorMap  map[byte][3]uint8
+	width     int
+	length    int64
+
+	palette  color.Palette
+	index    map[[3]uint8]uint8
+	blackIdx uint8
+	whiteIdx uint8
+
+	idat    *idatChunkWriter
+	zw      *zlib.Writer
+	row     []uint8 // in-progress scanline, grows up to width
+	written int64   // payload bytes written so far
+	crc     uint32  // running CRC32 state, not yet finalized with the closing XOR
+
+	initErr error
+	closed  bool
+}
+
+// NewEncoder returns an Encoder that streams a single PNG image to w,
+// encoding written bytes with opts.ColorMode's active color map. It writes
+// the PNG signature, IHDR and PLTE chunks immediately, since opts.Length
+// makes the final image height known up front.
+func NewEncoder(w io.Writer, opts EncoderOptions) *Encoder {
+	colorMode := opts.ColorMode
+	if colorMode != "8bit" {
+		colorMode = "16bit"
+	}
+	colorMap := colorMap16bit
+	if colorMode == "8bit" {
+		colorMap = colorMap8bit
+	}
+
+	width := opts.Width
+	if width <= 0 {
+		width = defaultStreamWidth
+	}
+
+	palette, index, blackIdx, whiteIdx := buildPalette(colorMap)
+
+	e := &Encoder{
+		w:         w,
+		colorMode: colorMode,
+		colorMap:  colorMap,
+		width:     width,
+		length:    opts.Length,
+		palette:   palette,
+		index:     index,
+		blackIdx:  blackIdx,
+		whiteIdx:  whiteIdx,
+		row:       make([]uint8, 0, width),
+		crc:       0xffffffff,
+	}
+	e.initErr = e.init()
+	return e
+}
+
+// init writes the PNG signature, IHDR and PLTE chunks, and the container
+// header (with a placeholder CRC32), then opens the IDAT stream that Write
+// and Close append scanlines to.
+func (e *Encoder) init() error {
+	totalChars := int64(containerHeaderSize)*int64(charsPerByteForMode(e.colorMode)) +
+		e.length*int64(charsPerByteForMode(e.colorMode)) +
+		4*int64(charsPerByteForMode(e.colorMode)) // trailing CRC32 trailer
+	totalPixels := totalChars
+	if rem := totalPixels % int64(e.width); rem != 0 {
+		totalPixels += int64(e.width) - rem
+	}
+	height := totalPixels / int64(e.width)
+
+	if _, err := e.w.Write(pngSignature[:]); err != nil {
+		return err
+	}
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(e.width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(height))
+	ihdr[8] = 8  // bit depth
+	ihdr[9] = 3  // color type 3: palette
+	ihdr[10] = 0 // compression method
+	ihdr[11] = 0 // filter method
+	ihdr[12] = 0 // interlace method
+	if err := writePNGChunk(e.w, "IHDR", ihdr); err != nil {
+		return err
+	}
+
+	plte := make([]byte, 3*len(e.palette))
+	for i, c := range e.palette {
+		r, g, b, _ := c.RGBA()
+		plte[i*3] = uint8(r >> 8)
+		plte[i*3+1] = uint8(g >> 8)
+		plte[i*3+2] = uint8(b >> 8)
+	}
+	if err := writePNGChunk(e.w, "PLTE", plte); err != nil {
+		return err
+	}
+
+	e.idat = &idatChunkWriter{w: e.w}
+	e.zw = zlib.NewWriter(e.idat)
+
+	header := containerHeader{
+		Magic:     containerMagic,
+		Version:   containerVersion,
+		ColorMode: colorModeByte(e.colorMode),
+		PaletteID: paletteChecksum(e.colorMap),
+		Length:    uint32(e.length),
+		CRC32:     0, // placeholder; the real value is appended as a trailer
+	}
+	for _, b := range header.Bytes() {
+		for _, char := range encodeByteChars(b, e.colorMode) {
+			if err := e.emitChar(char); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Write encodes p and streams it into the image a scanline at a time.
+// Encoding itself never fails; I/O errors from the underlying writer are
+// returned. len(p) bytes written across all calls must equal the
+// EncoderOptions.Length given to NewEncoder: a p that would take the total
+// past it is rejected with an error and none of it is consumed.
+func (e *Encoder) Write(p []byte) (int, error) {
+	if e.initErr != nil {
+		return 0, e.initErr
+	}
+	if e.written+int64(len(p)) > e.length {
+		return 0, fmt.Errorf("wrote %d bytes, exceeding the declared length of %d", e.written+int64(len(p)), e.length)
+	}
+	for _, b := range p {
+		e.crc = (e.crc >> 8) ^ crc32Table[(e.crc^uint32(b))&0xff]
+		e.written++
+
+		for _, char := range encodeByteChars(b, e.colorMode) {
+			if err := e.emitChar(char); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// emitChar maps a single encoded character to a palette index, appends it
+// to the in-progress scanline, and flushes the scanline through zlib once
+// it reaches e.width pixels.
+func (e *Encoder) emitChar(char byte) error {
+	colorVal, exists := e.colorMap[char]
+	idx := e.blackIdx
+	if exists {
+		idx = e.index[colorVal]
+	}
+
+	e.row = append(e.row, idx)
+	if len(e.row) == e.width {
+		if err := e.flushRow(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushRow writes the filter byte (always 0, "None") and the completed
+// scanline through zlib, then resets the row buffer.
+func (e *Encoder) flushRow() error {
+	if _, err := e.zw.Write([]byte{0}); err != nil {
+		return err
+	}
+	if _, err := e.zw.Write(e.row); err != nil {
+		return err
+	}
+	e.row = e.row[:0]
+	return nil
+}
+
+// encodeByteChars returns the encoded characters (hex or octal digits) for
+// a single payload byte, matching convertToOctal/hex.EncodeToString.
+func encodeByteChars(b byte, colorMode string) []byte {
+	if colorMode == "8bit" {
+		return []byte(fmt.Sprintf("%03o", b))
+	}
+	return []byte(hex.EncodeToString([]byte{b}))
+}
+
+// Close appends the CRC32 trailer, pads the final scanline with white out
+// to the declared image height, and finalizes the zlib stream, the last
+// IDAT chunk and the IEND chunk.
+func (e *Encoder) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	if e.initErr != nil {
+		return e.initErr
+	}
+	if e.written != e.length {
+		return fmt.Errorf("wrote %d bytes, want the declared length of %d", e.written, e.length)
+	}
+
+	crc := e.crc ^ 0xffffffff
+	var crcBuf [4]byte
+	binary.BigEndian.PutUint32(crcBuf[:], crc)
+	for _, b := range crcBuf {
+		for _, char := range encodeByteChars(b, e.colorMode) {
+			if err := e.emitChar(char); err != nil {
+				return err
+			}
+		}
+	}
+
+	for len(e.row) != 0 && len(e.row) != e.width {
+		e.row = append(e.row, e.whiteIdx)
+		if len(e.row) == e.width {
+			if err := e.flushRow(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := e.zw.Close(); err != nil {
+		return err
+	}
+	if err := e.idat.Flush(); err != nil {
+		return err
+	}
+	return writePNGChunk(e.w, "IEND", nil)
+}
+
+// writePNGChunk writes a length-prefixed PNG chunk: a 4-byte big-endian
+// length, the 4-byte ASCII type, the data, and a CRC32 over type+data.
+func writePNGChunk(w io.Writer, chunkType string, data []byte) error {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(data)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(chunkType)); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	var crcBuf [4]byte
+	binary.BigEndian.PutUint32(crcBuf[:], pngChunkCRC(chunkType, data))
+	_, err := w.Write(crcBuf[:])
+	return err
+}
+
+// pngChunkCRC computes the CRC32 PNG expects over a chunk's type and data.
+func pngChunkCRC(chunkType string, data []byte) uint32 {
+	return crc32Checksum(append([]byte(chunkType), data...))
+}
+
+// idatChunkWriter buffers compressed bytes and flushes them as IDAT chunks
+// once idatChunkSize accumulates, so a multi-GB image never needs a single
+// IDAT chunk anywhere near its full compressed size in memory.
+type idatChunkWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (c *idatChunkWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		n := idatChunkSize - len(c.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		c.buf = append(c.buf, p[:n]...)
+		p = p[n:]
+		if len(c.buf) == idatChunkSize {
+			if err := c.Flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return total, nil
+}
+
+// Flush writes out any buffered bytes as a single IDAT chunk.
+func (c *idatChunkWriter) Flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	err := writePNGChunk(c.w, "IDAT", c.buf)
+	c.buf = c.buf[:0]
+	return err
+}
+
+// Decoder streams a palette-indexed image's payload back out scanline by
+// scanline, hand-parsing the PNG container so that reconstructing a
+// multi-GB file never requires materializing the full decoded image, or
+// the full decoded byte string, in memory at once.
+type Decoder struct {
+	zr        io.ReadCloser
+	br        *bufio.Reader
+	width     int
+	colorMode string
+	idxToChar map[uint8]byte
+}
+
+// NewDecoder parses the PNG signature, IHDR and PLTE chunks read from r,
+// determines which color mode produced the image from the palette size,
+// and leaves the IDAT stream positioned at the first scanline, ready for
+// WriteTo to stream the validated payload out.
+func NewDecoder(r io.Reader) (*Decoder, error) {
+	br := bufio.NewReader(r)
+
+	var sig [8]byte
+	if _, err := io.ReadFull(br, sig[:]); err != nil {
+		return nil, fmt.Errorf("error reading PNG signature: %v", err)
+	}
+	if sig != pngSignature {
+		return nil, fmt.Errorf("not a PNG file")
+	}
+
+	chunkType, ihdr, err := readPNGChunk(br)
+	if err != nil {
+		return nil, fmt.Errorf("error reading IHDR: %v", err)
+	}
+	if chunkType != "IHDR" || len(ihdr) != 13 {
+		return nil, fmt.Errorf("expected IHDR chunk, got %q", chunkType)
+	}
+	width := int(binary.BigEndian.Uint32(ihdr[0:4]))
+	if ihdr[8] != 8 || ihdr[9] != 3 {
+		return nil, fmt.Errorf("expected an 8-bit paletted PNG, got bit depth %d color type %d", ihdr[8], ihdr[9])
+	}
+
+	chunkType, plte, err := readPNGChunk(br)
+	if err != nil {
+		return nil, fmt.Errorf("error reading PLTE: %v", err)
+	}
+	if chunkType != "PLTE" {
+		return nil, fmt.Errorf("expected PLTE chunk, got %q", chunkType)
+	}
+
+	colorMode, idxToChar, err := paletteModeAndIndex(plte)
+	if err != nil {
+		return nil, err
+	}
+
+	idatReader := &pngIDATReader{r: br}
+	zr, err := zlib.NewReader(idatReader)
+	if err != nil {
+		return nil, fmt.Errorf("error opening compressed stream: %v", err)
+	}
+
+	return &Decoder{
+		zr:        zr,
+		br:        bufio.NewReader(zr),
+		width:     width,
+		colorMode: colorMode,
+		idxToChar: idxToChar,
+	}, nil
+}
+
+// paletteModeAndIndex determines 8bit/16bit mode from the PLTE chunk's
+// length (colorMap8bit and colorMap16bit are 8 and 16 entries respectively,
+// both already including the black/white slots buildPalette would
+// otherwise add) and builds a palette-index -> encoded-character map.
+func paletteModeAndIndex(plte []byte) (string, map[uint8]byte, error) {
+	if len(plte)%3 != 0 {
+		return "", nil, fmt.Errorf("malformed PLTE chunk: %d bytes isn't a multiple of 3", len(plte))
+	}
+	entries := len(plte) / 3
+
+	colorMode := "16bit"
+	reverseMap := reverseColorMap16bit
+	if entries == len(colorMap8bit) {
+		colorMode = "8bit"
+		reverseMap = reverseColorMap8bit
+	} else if entries != len(colorMap16bit) {
+		return "", nil, fmt.Errorf("unrecognized palette size: %d entries", entries)
+	}
+
+	idxToChar := make(map[uint8]byte, entries)
+	for i := 0; i < entries; i++ {
+		rgb := [3]uint8{plte[i*3], plte[i*3+1], plte[i*3+2]}
+		if char, ok := reverseMap[rgb]; ok {
+			idxToChar[uint8(i)] = char
+		}
+	}
+	return colorMode, idxToChar, nil
+}
+
+// readPNGChunk reads one length-prefixed PNG chunk (type + data), verifies
+// its CRC32, and returns the chunk type and data.
+func readPNGChunk(r io.Reader) (string, []byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return "", nil, err
+	}
+	length := binary.BigEndian.Uint32(lenBuf[:])
+
+	typeAndData := make([]byte, 4+length)
+	if _, err := io.ReadFull(r, typeAndData); err != nil {
+		return "", nil, err
+	}
+	chunkType := string(typeAndData[:4])
+	data := typeAndData[4:]
+
+	var crcBuf [4]byte
+	if _, err := io.ReadFull(r, crcBuf[:]); err != nil {
+		return "", nil, err
+	}
+	if want := pngChunkCRC(chunkType, data); binary.BigEndian.Uint32(crcBuf[:]) != want {
+		return "", nil, fmt.Errorf("CRC32 mismatch on %s chunk", chunkType)
+	}
+	return chunkType, data, nil
+}
+
+// pngIDATReader serves the concatenated data bytes of consecutive IDAT
+// chunks as a plain io.Reader, so zlib.NewReader can decompress them one
+// scanline's worth at a time instead of needing the whole compressed
+// stream up front. It stops at the first non-IDAT chunk (IEND).
+type pngIDATReader struct {
+	r         io.Reader
+	remaining uint32
+	done      bool
+}
+
+func (p *pngIDATReader) Read(buf []byte) (int, error) {
+	if p.done {
+		return 0, io.EOF
+	}
+	if p.remaining == 0 {
+		chunkType, data, err := p.nextChunkHeader()
+		if err != nil {
+			return 0, err
+		}
+		if chunkType != "IDAT" {
+			p.done = true
+			return 0, io.EOF
+		}
+		p.remaining = data
+	}
+
+	n := len(buf)
+	if uint32(n) > p.remaining {
+		n = int(p.remaining)
+	}
+	read, err := io.ReadFull(p.r, buf[:n])
+	p.remaining -= uint32(read)
+	if err != nil {
+		return read, err
+	}
+	if err := p.skipCRC(); err != nil {
+		return read, err
+	}
+	return read, nil
+}
+
+// nextChunkHeader reads the next chunk's length+type fields, leaving the
+// reader positioned at the start of its data.
+func (p *pngIDATReader) nextChunkHeader() (string, uint32, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(p.r, lenBuf[:]); err != nil {
+		return "", 0, err
+	}
+	length := binary.BigEndian.Uint32(lenBuf[:])
+
+	var typeBuf [4]byte
+	if _, err := io.ReadFull(p.r, typeBuf[:]); err != nil {
+		return "", 0, err
+	}
+	return string(typeBuf[:]), length, nil
+}
+
+// skipCRC discards a chunk's trailing 4-byte CRC32 once remaining reaches
+// zero. Read calls it after every read; while data bytes of the current
+// chunk remain it does nothing.
+func (p *pngIDATReader) skipCRC() error {
+	if p.remaining != 0 {
+		return nil
+	}
+	var crcBuf [4]byte
+	_, err := io.ReadFull(p.r, crcBuf[:])
+	return err
+}
+
+// WriteTo streams the decoded payload to w one scanline at a time, holding
+// only a row's worth of pixels plus fixed-size buffers (bufio and zlib's
+// bounded window) in memory, then reports how many bytes it wrote. The
+// CRC32 trailer is checked once the whole payload has been decoded; by then
+// payload bytes may already have reached w, and a mismatch is returned as
+// an error.
+func (d *Decoder) WriteTo(w io.Writer) (int64, error) {
+	charsPerByte := charsPerByteForMode(d.colorMode)
+	headerChars := containerHeaderSize * charsPerByte
+
+	bw := bufio.NewWriter(w)
+	var written int64
+	var headerBuf, charBuf []byte
+	var header containerHeader
+	haveHeader := false
+
+	crc := uint32(0xffffffff)
+	var crcTrailerBuf []byte
+	haveCRCTrailer := false
+
+	row := make([]byte, d.width+1) // filter byte + width indices
+	for {
+		if _, err := io.ReadFull(d.br, row); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return written, fmt.Errorf("error reading scanline: %v", err)
+		}
+		if row[0] != 0 {
+			return written, fmt.Errorf("unsupported PNG filter type %d", row[0])
+		}
+
+		for _, idx := range row[1:] {
+			char, ok := d.idxToChar[idx]
+			if !ok {
+				continue
+			}
+
+			if !haveHeader {
+				headerBuf = append(headerBuf, char)
+				if len(headerBuf) != headerChars {
+					continue
+				}
+				hdrBytes, err := decodeCharGroup(headerBuf, d.colorMode)
+				if err != nil {
+					return written, fmt.Errorf("error decoding header: %v", err)
+				}
+				header, err = parseContainerHeader(hdrBytes)
+				if err != nil {
+					return written, fmt.Errorf("error parsing container header: %v", err)
+				}
+				if colorModeName(header.ColorMode) != d.colorMode {
+					return written, fmt.Errorf("header color mode %q does not match detected mode %q", colorModeName(header.ColorMode), d.colorMode)
+				}
+				if active := paletteChecksum(activeColorMapForMode(d.colorMode)); header.PaletteID != active {
+					return written, fmt.Errorf("header palette checksum %02x does not match the active %s scheme (%02x); decode with the scheme used to encode", header.PaletteID, d.colorMode, active)
+				}
+				haveHeader = true
+				continue
+			}
+
+			if written >= int64(header.Length) {
+				if haveCRCTrailer {
+					continue
+				}
+				crcTrailerBuf = append(crcTrailerBuf, char)
+				if len(crcTrailerBuf) != 4*charsPerByte {
+					continue
+				}
+				trailerBytes, err := decodeCharGroup(crcTrailerBuf, d.colorMode)
+				if err != nil {
+					return written, fmt.Errorf("error decoding CRC32 trailer: %v", err)
+				}
+				wantCRC := binary.BigEndian.Uint32(trailerBytes)
+				if gotCRC := crc ^ 0xffffffff; gotCRC != wantCRC {
+					return written, fmt.Errorf("CRC32 mismatch: image data is corrupted (got %08x, want %08x)", gotCRC, wantCRC)
+				}
+				haveCRCTrailer = true
+				continue
+			}
+
+			charBuf = append(charBuf, char)
+			if len(charBuf) != charsPerByte {
+				continue
+			}
+			group := charBuf
+			charBuf = nil
+
+			b, err := decodeCharGroup(group, d.colorMode)
+			if err != nil {
+				return written, err
+			}
+			if remaining := int64(header.Length) - written; int64(len(b)) > remaining {
+				b = b[:remaining]
+			}
+			for _, by := range b {
+				crc = (crc >> 8) ^ crc32Table[(crc^uint32(by))&0xff]
+			}
+			n, err := bw.Write(b)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+
+	if haveHeader && !haveCRCTrailer {
+		return written, fmt.Errorf("image ended before its CRC32 trailer could be read")
+	}
+	if err := bw.Flush(); err != nil {
+		return written, err
+	}
+	return written, nil
+}
+
+// decodeCharGroup decodes a fixed-size group of encoded characters (a hex
+// pair or an octal triple) back to raw bytes.
+func decodeCharGroup(group []byte, colorMode string) ([]byte, error) {
+	if colorMode == "8bit" {
+		return convertFromOctal(string(group))
+	}
+	return hex.DecodeString(string(group))
+}
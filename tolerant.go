@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// squaredDistance returns the squared Euclidean distance between two RGB
+// colors. Squared distance avoids a sqrt per pixel and preserves ordering,
+// which is all nearest-color matching needs.
+func squaredDistance(a, b [3]uint8) int {
+	dr := int(a[0]) - int(b[0])
+	dg := int(a[1]) - int(b[1])
+	db := int(a[2]) - int(b[2])
+	return dr*dr + dg*dg + db*db
+}
+
+// nearestPaletteChar finds the palette entry closest to rgb by squared RGB
+// distance. ok is false if the closest entry is farther than maxDist, in
+// which case the pixel should be treated as end-of-data/white.
+func nearestPaletteChar(rgb [3]uint8, colorMap map[byte][3]uint8, maxDist int) (char byte, ok bool) {
+	best := -1
+	for c, candidate := range colorMap {
+		d := squaredDistance(rgb, candidate)
+		if best == -1 || d < best {
+			best = d
+			char = c
+		}
+	}
+	if best == -1 || best > maxDist {
+		return 0, false
+	}
+	return char, true
+}
+
+// averageNearestNeighborDistance scores how well colorMap explains the
+// non-white pixels of an image, used to auto-detect which palette produced
+// a lossy/photographed image.
+func averageNearestNeighborDistance(img image.Image, colorMap map[byte][3]uint8) float64 {
+	bounds := img.Bounds()
+	var total float64
+	var count int
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			rgb := [3]uint8{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)}
+			if rgb == [3]uint8{255, 255, 255} {
+				continue
+			}
+			best := -1
+			for _, candidate := range colorMap {
+				d := squaredDistance(rgb, candidate)
+				if best == -1 || d < best {
+					best = d
+				}
+			}
+			total += float64(best)
+			count++
+		}
+	}
+
+	if count == 0 {
+		return math.MaxFloat64
+	}
+	return total / float64(count)
+}
+
+// detectTolerantPalette scores both the 8bit and 16bit palettes by average
+// nearest-neighbor distance across all non-white pixels and returns whichever
+// scores lower, i.e. whichever palette the image's colors sit closest to.
+// A tie goes to 8bit: its colors are a subset of the 16bit palette, so an
+// 8-bit image scores the same under both.
+func detectTolerantPalette(img image.Image) (colorMode string, colorMap map[byte][3]uint8) {
+	score16 := averageNearestNeighborDistance(img, colorMap16bit)
+	score8 := averageNearestNeighborDistance(img, colorMap8bit)
+	if score8 <= score16 {
+		return "8bit", colorMap8bit
+	}
+	return "16bit", colorMap16bit
+}
+
+// reconstructDataFromImageTolerant decodes an image that may have been
+// recompressed (e.g. as a JPEG) or photographed, where pixels no longer
+// match the original palette colors exactly. It auto-detects the palette
+// that was most likely used, then maps each pixel to its nearest palette
+// color, treating anything farther than maxDist as end-of-data.
+func reconstructDataFromImageTolerant(img image.Image, maxDist int) (string, string, error) {
+	colorMode, colorMap := detectTolerantPalette(img)
+	fmt.Printf("Auto-detected %s palette for tolerant decoding\n", colorMode)
+
+	bounds := img.Bounds()
+	var result []byte
+
+loop:
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			rgb := [3]uint8{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)}
+
+			char, ok := nearestPaletteChar(rgb, colorMap, maxDist)
+			if !ok {
+				// A pixel farther than maxDist from every palette color is
+				// end-of-data padding, not a character to skip: stopping
+				// here keeps every character before it correctly aligned
+				// to its hex/octal group. Continuing past it would drop
+				// one character and shift every subsequent pair/triple.
+				break loop
+			}
+			result = append(result, char)
+		}
+	}
+
+	return string(result), colorMode, nil
+}